@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// extraPath — дополнительный каталог (или отдельный файл), который профиль подмешивает
+// в архив/манифест под своим префиксом, например "gitconfig" -> "~/.gitconfig".
+type extraPath struct {
+	Prefix string
+	Path   string
+}
+
+// profile описывает один именованный профиль синхронизации из config.yml: какие файлы
+// включать/исключать сверх стандартного shouldSkip, какие дополнительные пути тащить,
+// нужно ли шифрование и на каком адресе слушать сервер.
+type profile struct {
+	Name       string
+	Include    []string
+	Exclude    []string
+	ExtraPaths []extraPath
+	Encrypt    bool
+	Bind       string
+}
+
+// config — содержимое config.yml: набор именованных профилей.
+type config struct {
+	Profiles map[string]*profile
+}
+
+// defaultConfigPath возвращает ~/.config/vscode-settings-sync/config.yml.
+func defaultConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "vscode-settings-sync", "config.yml"), nil
+}
+
+// loadProfile загружает профиль name из config.yml (configPath, либо путь по умолчанию,
+// если configPath пустой). Если name пустое — флаг -profile не задан, и возвращается
+// пустой профиль (означает: старое поведение, синхронизировать все дерево целиком).
+func loadProfile(configPath string, name string) (*profile, error) {
+	if name == "" {
+		return &profile{}, nil
+	}
+
+	if configPath == "" {
+		var err error
+		configPath, err = defaultConfigPath()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать конфиг %s: %w", configPath, err)
+	}
+
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("профиль %q не найден в %s", name, configPath)
+	}
+	return p, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigYAML(string(data))
+}
+
+// parseConfigYAML разбирает небольшое подмножество YAML, которого достаточно для
+// описанных ниже профилей. Отдельную зависимость вроде gopkg.in/yaml.v3 ради одного
+// файла конфига решили не тянуть (см. тот же подход в syncenc/pbkdf2.go).
+//
+// Ожидаемая форма:
+//
+//	profiles:
+//	  work:
+//	    include:
+//	      - "globalStorage/rooveterinaryinc.roo-cline/**"
+//	    exclude:
+//	      - "globalStorage/github.copilot*/**"
+//	    extra_paths:
+//	      gitconfig: /home/user/.gitconfig
+//	    encrypt: true
+//	    bind: 0.0.0.0:8080
+func parseConfigYAML(data string) (*config, error) {
+	cfg := &config{Profiles: map[string]*profile{}}
+
+	var cur *profile
+	var listTarget *[]string
+	inExtraPaths := false
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := stripYAMLComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := countIndent(line)
+		trimmed := strings.TrimSpace(line)
+
+		if indent == 0 {
+			cur = nil
+			listTarget = nil
+			inExtraPaths = false
+			continue // единственный ожидаемый ключ верхнего уровня — "profiles:"
+		}
+
+		if indent == 2 && !strings.HasPrefix(trimmed, "-") {
+			key, _, _ := splitYAMLKeyVal(trimmed)
+			cur = &profile{Name: unquoteYAML(key)}
+			cfg.Profiles[cur.Name] = cur
+			listTarget = nil
+			inExtraPaths = false
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+
+		if indent == 4 {
+			key, val, hasVal := splitYAMLKeyVal(trimmed)
+			listTarget = nil
+			inExtraPaths = false
+			switch key {
+			case "include":
+				listTarget = &cur.Include
+			case "exclude":
+				listTarget = &cur.Exclude
+			case "extra_paths":
+				inExtraPaths = true
+			case "encrypt":
+				cur.Encrypt = unquoteYAML(val) == "true"
+			case "bind":
+				cur.Bind = unquoteYAML(val)
+			}
+			_ = hasVal
+			continue
+		}
+
+		if indent >= 6 {
+			if listTarget != nil && strings.HasPrefix(trimmed, "-") {
+				item := unquoteYAML(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+				*listTarget = append(*listTarget, item)
+				continue
+			}
+			if inExtraPaths {
+				key, val, hasVal := splitYAMLKeyVal(trimmed)
+				if hasVal {
+					cur.ExtraPaths = append(cur.ExtraPaths, extraPath{Prefix: key, Path: unquoteYAML(val)})
+				}
+				continue
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func countIndent(line string) int {
+	n := 0
+	for _, r := range line {
+		if r != ' ' {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func stripYAMLComment(line string) string {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		return line[:idx]
+	}
+	return line
+}
+
+func splitYAMLKeyVal(trimmed string) (key, val string, hasVal bool) {
+	idx := strings.Index(trimmed, ":")
+	if idx < 0 {
+		return trimmed, "", false
+	}
+	key = strings.TrimSpace(trimmed[:idx])
+	val = strings.TrimSpace(trimmed[idx+1:])
+	return key, val, val != ""
+}
+
+func unquoteYAML(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 {
+		if (s[0] == '"' && s[len(s)-1] == '"') || (s[0] == '\'' && s[len(s)-1] == '\'') {
+			return s[1 : len(s)-1]
+		}
+	}
+	return s
+}
+
+// compileGlobs компилирует doublestar-паттерны ("**" — любое, в том числе нулевое,
+// число сегментов, "*" — один сегмент без "/") в *regexp.Regexp один раз — buildSkipFn
+// вызывает это при построении функции пропуска, а не на каждую проверку пути, потому
+// что сама функция пропуска дергается на каждый файл и каждую директорию при обходе
+// дерева (addFolderToZip, buildManifest), и перекомпиляция регулярки там была бы
+// дорогой (O(файлы × паттерны) на каждый синк). Невалидные паттерны молча пропускаются.
+func compileGlobs(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pat := range patterns {
+		re, err := globToRegexp(pat)
+		if err != nil {
+			continue
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled
+}
+
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// "**/" допускает и ноль сегментов: "a/**/b" совпадает с "a/b"
+			b.WriteString("(?:.*/)?")
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+			i++
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+			i++
+		case strings.ContainsRune(`\.+()|[]{}^$`, rune(pattern[i])):
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		default:
+			b.WriteByte(pattern[i])
+			i++
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// buildSkipFn собирает функцию пропуска файла для профиля: include всегда побеждает
+// (даже то, что shouldSkip пропустил бы по умолчанию), exclude дополнительно отсеивает
+// то, что shouldSkip оставил бы, а при отсутствии совпадений работает прежняя
+// захардкоженная логика shouldSkip. Чтобы обход дерева дошел до таких файлов, не
+// отсекаются каталоги, лежащие на начале include-паттерна до первого "*"/"?" (для
+// "globalStorage/x/**" — "globalStorage" и "globalStorage/x"); подкаталоги,
+// которые паттерн покрывает только подстановкой (как "globalStorage/*/state.json"),
+// по-прежнему отсекаются, если их отсекает shouldSkip или exclude.
+func buildSkipFn(p *profile) func(relPath string) bool {
+	if p == nil {
+		p = &profile{}
+	}
+	include := compileGlobs(p.Include)
+	exclude := compileGlobs(p.Exclude)
+	includeLits := make([]string, 0, len(p.Include))
+	for _, pat := range p.Include {
+		if i := strings.IndexAny(pat, "*?"); i >= 0 {
+			pat = pat[:i]
+		}
+		includeLits = append(includeLits, pat)
+	}
+	return func(relPath string) bool {
+		slashPath := filepath.ToSlash(relPath)
+		for _, lit := range includeLits {
+			if strings.HasPrefix(lit, slashPath+"/") {
+				return false
+			}
+		}
+		for _, re := range include {
+			if re.MatchString(slashPath) {
+				return false
+			}
+		}
+		for _, re := range exclude {
+			if re.MatchString(slashPath) {
+				return true
+			}
+		}
+		return shouldSkip(relPath)
+	}
+}
+
+// profileHash считает детерминированный отпечаток содержимого профиля (без имени и bind) —
+// сервер отдает его через /profile, а клиент отказывается накатывать синхронизацию,
+// если его локальный профиль с тем же именем дает другой хэш: значит, это разные
+// профили, и накатывать, например, "home" поверх "work" не стоит.
+func profileHash(p *profile) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "include=%v\n", p.Include)
+	fmt.Fprintf(h, "exclude=%v\n", p.Exclude)
+
+	extra := append([]extraPath{}, p.ExtraPaths...)
+	sort.Slice(extra, func(i, j int) bool { return extra[i].Prefix < extra[j].Prefix })
+	for _, ep := range extra {
+		fmt.Fprintf(h, "extra:%s=%s\n", ep.Prefix, ep.Path)
+	}
+
+	fmt.Fprintf(h, "encrypt=%v\n", p.Encrypt)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -2,52 +2,146 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/artross/vscode-settings-sync/syncenc"
 )
 
 // Задаем значение по умолчанию
 const (
 	DEFAULT_PORT = "8080"
+	// EnvPassphrase — переменная окружения, альтернатива флагу -passphrase
+	EnvPassphrase = "VSCSYNC_KEY"
+	// maxAuthSkew — допустимое расхождение часов клиента/сервера для X-Sync-Auth
+	maxAuthSkew = 60 * time.Second
+)
+
+// Поддерживаемые варианты установки VS Code (флаг --flavor)
+const (
+	FlavorStable   = "stable"
+	FlavorInsiders = "insiders"
+	FlavorOSS      = "oss"
+	FlavorServer   = "server"
 )
 
-// getVSCodePath возвращает путь к директории User настроек VS Code
-func getVSCodePath() (string, error) {
-	var basePath string
+// vscodePaths хранит пути к User-настройкам и папке extensions для конкретной установки VS Code
+type vscodePaths struct {
+	UserDir       string
+	ExtensionsDir string
+}
+
+// rootSpec — одна "ветка" дерева синхронизации: каталог (или отдельный файл) на диске
+// плюс префикс внутри архива/манифеста. UserDir/ExtensionsDir присутствуют всегда,
+// profile.ExtraPaths добавляет к ним то, что перечислено в config.yml.
+type rootSpec struct {
+	Dir    string
+	Prefix string
+}
+
+// syncRoots собирает список корней синхронизации для paths с учетом profile.ExtraPaths.
+func syncRoots(paths *vscodePaths, p *profile) []rootSpec {
+	roots := []rootSpec{
+		{paths.UserDir, "User"},
+		{paths.ExtensionsDir, "extensions"},
+	}
+	if p == nil {
+		return roots
+	}
+	for _, ep := range p.ExtraPaths {
+		roots = append(roots, rootSpec{Dir: ep.Path, Prefix: ep.Prefix})
+	}
+	return roots
+}
 
+// getVSCodePaths возвращает пути User/extensions для выбранного flavor (stable/insiders/oss/server)
+// на windows/darwin/linux, не завязываясь на os.Getenv в вызывающем коде.
+func getVSCodePaths(flavor string) (*vscodePaths, error) {
 	switch runtime.GOOS {
 	case "windows":
-		basePath = os.Getenv("APPDATA")
-		if basePath == "" {
-			return "", fmt.Errorf("не удалось получить переменную APPDATA")
+		appData := os.Getenv("APPDATA")
+		if appData == "" {
+			return nil, fmt.Errorf("не удалось получить переменную APPDATA")
 		}
-		return filepath.Join(basePath, "Code", "User"), nil
-	case "darwin":
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return "", err
+		userProfile := os.Getenv("USERPROFILE")
+		if userProfile == "" {
+			return nil, fmt.Errorf("не удалось получить переменную USERPROFILE")
+		}
+
+		var codeDir, extDirName string
+		switch flavor {
+		case FlavorInsiders:
+			codeDir, extDirName = "Code - Insiders", ".vscode-insiders"
+		case FlavorOSS:
+			codeDir, extDirName = "Code - OSS", ".vscode-oss"
+		case FlavorServer:
+			return nil, fmt.Errorf("flavor %q не поддерживается на windows", FlavorServer)
+		case FlavorStable, "":
+			codeDir, extDirName = "Code", ".vscode"
+		default:
+			return nil, fmt.Errorf("неизвестный flavor: %s", flavor)
 		}
-		return filepath.Join(home, "Library", "Application Support", "Code", "User"), nil
-	case "linux":
+
+		return &vscodePaths{
+			UserDir:       filepath.Join(appData, codeDir, "User"),
+			ExtensionsDir: filepath.Join(userProfile, extDirName, "extensions"),
+		}, nil
+	case "darwin", "linux":
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+
+		if flavor == FlavorServer {
+			// code-server держит и настройки, и расширения под одним каталогом данных
+			return &vscodePaths{
+				UserDir:       filepath.Join(home, ".local", "share", "code-server", "User"),
+				ExtensionsDir: filepath.Join(home, ".local", "share", "code-server", "extensions"),
+			}, nil
+		}
+
+		var appDirName, extDirName string
+		switch flavor {
+		case FlavorInsiders:
+			appDirName, extDirName = "Code - Insiders", ".vscode-insiders"
+		case FlavorOSS:
+			appDirName, extDirName = "Code - OSS", ".vscode-oss"
+		case FlavorStable, "":
+			appDirName, extDirName = "Code", ".vscode"
+		default:
+			return nil, fmt.Errorf("неизвестный flavor: %s", flavor)
+		}
+
+		var userDir string
+		if runtime.GOOS == "darwin" {
+			userDir = filepath.Join(home, "Library", "Application Support", appDirName, "User")
+		} else {
+			userDir = filepath.Join(home, ".config", appDirName, "User")
 		}
-		return filepath.Join(home, ".config", "Code", "User"), nil
+
+		return &vscodePaths{
+			UserDir:       userDir,
+			ExtensionsDir: filepath.Join(home, extDirName, "extensions"),
+		}, nil
 	default:
-		return "", fmt.Errorf("неподдерживаемая ОС: %s", runtime.GOOS)
+		return nil, fmt.Errorf("неподдерживаемая ОС: %s", runtime.GOOS)
 	}
 }
 
@@ -98,110 +192,203 @@ func getLocalIP() string {
 	return ""
 }
 
-// zipSource архивирует папку source в байтовый буфер
-func zipSource(source string) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	w := zip.NewWriter(buf)
-
-	walker := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
+// windowsAbsPathPattern ловит пути вида "C:\foo" или "C:/foo" — filepath.IsAbs на
+// non-windows платформах их абсолютными не считает, а архив могли собрать где угодно.
+var windowsAbsPathPattern = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+
+// unzipDest распаковывает архив из reader в папку dest. Вместо буферизации всего
+// архива в памяти (как раньше) и распаковки "на живую", теперь:
+//  1. архив стримится во временный файл на диске — так осиливаются многогигабайтные extensions;
+//  2. каждая запись проверяется на ZipSlip относительно канонического (без симлинков) staging-пути,
+//     абсолютные пути и пути с буквой диска Windows отклоняются;
+//  3. символьные ссылки и прочие не-regular записи (потенциальные hardlink/device) отклоняются;
+//  4. распаковка идет во временную staging-директорию, которая атомарно подменяет dest через os.Rename,
+//     так что падение посреди распаковки не может оставить настройки в наполовину примененном виде.
+func unzipDest(reader io.Reader, dest string) error {
+	tmpZip, err := os.CreateTemp("", "vscsync-*.zip")
+	if err != nil {
+		return fmt.Errorf("не удалось создать временный файл архива: %w", err)
+	}
+	tmpZipPath := tmpZip.Name()
+	defer os.Remove(tmpZipPath)
 
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+	_, copyErr := io.Copy(tmpZip, reader)
+	closeErr := tmpZip.Close()
+	if copyErr != nil {
+		return fmt.Errorf("не удалось сохранить архив во временный файл: %w", copyErr)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
 
-		// Создаем путь внутри архива относительно папки source
-		f, err := w.Create(path[len(source):])
-		if err != nil {
-			return err
-		}
+	zr, err := zip.OpenReader(tmpZipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
 
-		_, err = io.Copy(f, file)
+	parent := filepath.Dir(dest)
+	if err := os.MkdirAll(parent, 0755); err != nil {
 		return err
 	}
 
-	err := filepath.Walk(source, walker)
+	staging, err := os.MkdirTemp(parent, ".vscsync-staging-*")
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("не удалось создать staging-директорию: %w", err)
 	}
+	defer os.RemoveAll(staging)
 
-	err = w.Close()
+	stagingCanon, err := filepath.EvalSymlinks(staging)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("не удалось канонизировать staging-директорию: %w", err)
+	}
+
+	for _, f := range zr.File {
+		if err := extractZipEntry(f, stagingCanon); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("не удалось освободить место под новые настройки: %w", err)
+		}
 	}
 
-	return buf, nil
+	return os.Rename(staging, dest)
 }
 
-// unzipDest распаковывает архив из reader в папку dest
-func unzipDest(reader io.Reader, dest string) error {
-	os.MkdirAll(dest, 0755)
+// extractZipEntry безопасно распаковывает один элемент архива в канонизированную
+// (через filepath.EvalSymlinks) директорию stagingCanon.
+func extractZipEntry(f *zip.File, stagingCanon string) error {
+	return extractZipEntryNamed(f, f.Name, stagingCanon)
+}
+
+// extractZipEntryNamed — то же самое, что extractZipEntry, но с путем записи,
+// переопределенным на name (используется дельта-синком: у файла в архиве есть
+// префикс "User/"/"extensions/", который нужно срезать перед тем, как класть
+// его в staging конкретного корня).
+func extractZipEntryNamed(f *zip.File, name string, stagingCanon string) error {
+	if filepath.IsAbs(name) || windowsAbsPathPattern.MatchString(name) {
+		return fmt.Errorf("недопустимый абсолютный путь в архиве: %s", name)
+	}
+
+	mode := f.Mode()
+	if mode&os.ModeSymlink != 0 {
+		return fmt.Errorf("символьные ссылки в архиве запрещены: %s", name)
+	}
+	// У zip нет понятия hardlink, но не-regular записи (device/pipe/socket), которые
+	// иногда используют для того же класса атак, отклоняем по той же логике.
+	if mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket|os.ModeIrregular) != 0 {
+		return fmt.Errorf("недопустимый тип записи в архиве (ожидался файл или папка): %s", name)
+	}
+
+	fpath := filepath.Join(stagingCanon, filepath.FromSlash(name))
+
+	// Защита от ZipSlip: итоговый путь должен остаться внутри stagingCanon
+	if fpath != stagingCanon && !strings.HasPrefix(fpath, stagingCanon+string(os.PathSeparator)) {
+		return fmt.Errorf("недопустимый путь файла (выход за пределы staging): %s", name)
+	}
+
+	if f.FileInfo().IsDir() {
+		return os.MkdirAll(fpath, f.Mode())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(reader)
+	// В staging может лежать жесткая ссылка из hardlinkSnapshot: убираем ее, чтобы
+	// запись шла в новый файл, а не в данные, общие с исходником и бэкапом.
+	if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 	if err != nil {
 		return err
 	}
+	defer outFile.Close()
 
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
 
-		// Защита от ZipSlip
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("недопустимый путь файла: %s", fpath)
-		}
+	_, err = io.Copy(outFile, rc)
+	return err
+}
 
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, f.Mode())
-			continue
-		}
+// backupDir делает недорогой снимок path в path_backup_<timestamp>: для каждого файла
+// пытается сделать жесткую ссылку (os.Link) и только при неудаче (другой том, ФС без
+// поддержки hardlink) копирует байты. В отличие от старой версии (os.Rename), path
+// не перемещается — дельта-синку и полной синхронизации он по-прежнему нужен на
+// месте как источник для staging-директории.
+func backupDir(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	timestamp := time.Now().Format("20060102-150405")
+	dest := path + "_backup_" + timestamp
 
-		parentDir := filepath.Dir(fpath)
-		if err := os.MkdirAll(parentDir, 0755); err != nil {
+	fmt.Printf("Создание бэкапа текущих настроек в: %s\n", dest)
+	return hardlinkSnapshot(path, dest)
+}
+
+// hardlinkSnapshot рекурсивно зеркалит srcDir в dstDir. Для файлов сперва пробует
+// os.Link (почти бесплатно: данные не копируются, ссылка делит их с исходным файлом,
+// так что снимок остается прежним, пока файл заменяют, а не переписывают на месте), а если
+// hardlink невозможен — откатывается на обычное копирование содержимого.
+func hardlinkSnapshot(srcDir, dstDir string) error {
+	return filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
 
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		rel, err := filepath.Rel(srcDir, path)
 		if err != nil {
 			return err
 		}
+		target := filepath.Join(dstDir, rel)
 
-		rc, err := f.Open()
+		info, err := d.Info()
 		if err != nil {
-			outFile.Close()
 			return err
 		}
 
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
 
-		if err != nil {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 			return err
 		}
-	}
-	return nil
+		if err := os.Link(path, target); err != nil {
+			return copyFileContents(path, target, info.Mode())
+		}
+		return nil
+	})
 }
 
-func backupDir(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return nil
+// copyFileContents — запасной вариант hardlinkSnapshot для файлов, для которых
+// os.Link не сработал (например, src и dst на разных томах).
+func copyFileContents(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
 
-	timestamp := time.Now().Format("20060102-150405")
-	dest := path + "_backup_" + timestamp
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
 
-	fmt.Printf("Создание бэкапа текущих настроек в: %s\n", dest)
-	return os.Rename(path, dest)
+	_, err = io.Copy(out, in)
+	return err
 }
 
 // --- ДЛЯ ВЕРСИИ 2.0 ---
@@ -235,7 +422,7 @@ func shouldSkip(path string) bool {
 //   - folderPath — откуда берем (абсолютный путь на диске)
 //   - zipPath — префикс внутри архива (например, "User" или "extensions")
 //   - archive — наш запущенный зип-райтер
-func addFolderToZip(folderPath string, zipPath string, archive *zip.Writer) error {
+func addFolderToZip(folderPath string, zipPath string, archive *zip.Writer, skip func(string) bool) error {
 	return filepath.WalkDir(folderPath, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -246,8 +433,8 @@ func addFolderToZip(folderPath string, zipPath string, archive *zip.Writer) erro
 		// Соединяем с префиксом (например, "User/settings.json")
 		entryName := filepath.Join(zipPath, relPath)
 
-		// Наш фильтр из предыдущего шага
-		if shouldSkip(relPath) {
+		// Наш фильтр (по умолчанию shouldSkip, либо профильные include/exclude — см. buildSkipFn)
+		if skip(relPath) {
 			if d.IsDir() {
 				return filepath.SkipDir
 			}
@@ -281,30 +468,177 @@ func addFolderToZip(folderPath string, zipPath string, archive *zip.Writer) erro
 	})
 }
 
+// addFilesToZip добавляет в архив только перечисленные в files архивные пути
+// (например, "User/settings.json", "extensions/foo/package.json") — используется
+// дельта-синком, чтобы /sync отдавал не всё дерево, а только изменившиеся файлы.
+func addFilesToZip(paths *vscodePaths, p *profile, files []string, archive *zip.Writer) error {
+	roots := syncRoots(paths, p)
+	for _, archivePath := range files {
+		var matched *rootSpec
+		for i := range roots {
+			if archivePath == roots[i].Prefix || strings.HasPrefix(archivePath, roots[i].Prefix+"/") {
+				matched = &roots[i]
+				break
+			}
+		}
+		if matched == nil {
+			return fmt.Errorf("неизвестный префикс в списке файлов: %s", archivePath)
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(archivePath, matched.Prefix), "/")
+		diskPath := filepath.Join(matched.Dir, filepath.FromSlash(rel))
+
+		info, err := os.Stat(diskPath)
+		if err != nil {
+			return fmt.Errorf("файл %s не найден на сервере: %w", archivePath, err)
+		}
+		if info.IsDir() {
+			continue
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = archivePath
+		header.Method = zip.Deflate
+
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(diskPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // --- СЕРВЕРНАЯ ЧАСТЬ ---
 
-func runServer(port string) {
-	localIP := getLocalIP()
-	if localIP == "" {
-		fmt.Printf("Ошибка при старте сервера: не определен ip-адрес для подключения")
-		return
+// deriveServerKey проверяет требование profile.Encrypt и, если задан passphrase,
+// генерирует соль и выводит из нее ключ AES-256-GCM. Вынесено из runServer и не
+// требует реального TCP-листенера.
+func deriveServerKey(passphrase string, activeProfile *profile) (encKey, salt []byte, err error) {
+	if activeProfile.Encrypt && passphrase == "" {
+		return nil, nil, fmt.Errorf("профиль %q требует шифрование (encrypt: true), но -passphrase/VSCSYNC_KEY не заданы", activeProfile.Name)
+	}
+	if passphrase == "" {
+		return nil, nil, nil
+	}
+	salt, err = syncenc.NewSalt()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка генерации соли шифрования: %w", err)
 	}
+	return syncenc.DeriveKey(passphrase, salt), salt, nil
+}
 
-	displayAddr := fmt.Sprintf("%s:%s", localIP, port)
+// newSyncMux регистрирует /profile, /salt, /manifest и /sync на новом http.ServeMux.
+// Вынесено из runServer, чтобы тесты могли поднять httptest.NewServer с той же логикой,
+// не завязываясь на os.Signal/ListenAndServe.
+func newSyncMux(paths *vscodePaths, activeProfile *profile, encKey, salt []byte) *http.ServeMux {
+	mux := http.NewServeMux()
 
-	fmt.Println("========================================")
-	fmt.Printf("✅ Сервер успешно запущен!\n")
-	fmt.Printf("На клиенте используйте команду:\n")
-	fmt.Printf("> vscode-settings-sync client %s\n", displayAddr)
-	fmt.Println("========================================")
-	fmt.Println("Ожидание подключений...")
+	// Отдаем имя и хэш активного профиля, чтобы клиент с -profile мог отказаться
+	// накатывать синхронизацию, если его локальный профиль определен иначе.
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Только GET запросы", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.Marshal(struct {
+			Name string `json:"name"`
+			Hash string `json:"hash"`
+		}{Name: activeProfile.Name, Hash: profileHash(activeProfile)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
 
-	// Настраиваем HTTP-обработчик
-	http.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+	// Если включено шифрование — отдаем соль по отдельному (открытому) эндпоинту,
+	// чтобы клиент мог вывести из неё тот же ключ до аутентифицированного запроса.
+	mux.HandleFunc("/salt", func(w http.ResponseWriter, r *http.Request) {
+		if encKey == nil {
+			http.Error(w, "шифрование не включено на сервере", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, hex.EncodeToString(salt))
+	})
+
+	// Отдаем манифест (path/size/mtime/sha256/mode на каждый файл), чтобы клиент мог
+	// запросить только изменившиеся файлы вместо полного дерева.
+	mux.HandleFunc("/manifest", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Только GET запросы", http.StatusMethodNotAllowed)
 			return
 		}
+		if encKey != nil && !checkSyncAuth(r, encKey, nil) {
+			http.Error(w, "отсутствует или недействителен X-Sync-Auth", http.StatusUnauthorized)
+			return
+		}
+
+		entries, err := buildManifest(paths, activeProfile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data, err := marshalManifest(entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+
+	// Настраиваем HTTP-обработчик
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Только GET или POST запросы", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Дельта-синк: ?files=User/a,extensions/b или POST с JSON-списком строк.
+		// Если список не передан — отдаем полное дерево (совместимость со старым клиентом).
+		// Парсим files ДО проверки подписи: filesDigest входит в X-Sync-Auth, иначе
+		// перехваченную подпись можно переиграть с другим списком файлов.
+		var files []string
+		if query := r.URL.Query(); query.Has("files") {
+			// Пустой "?files=" (например, синк только с удалениями) дает пустой архив.
+			files = []string{}
+			if list := query.Get("files"); list != "" {
+				files = strings.Split(list, ",")
+			}
+		} else if r.Method == http.MethodPost {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(body) > 0 {
+				if err := json.Unmarshal(body, &files); err != nil {
+					http.Error(w, fmt.Sprintf("не удалось разобрать список файлов: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		if encKey != nil && !checkSyncAuth(r, encKey, files) {
+			http.Error(w, "отсутствует или недействителен X-Sync-Auth", http.StatusUnauthorized)
+			return
+		}
 
 		fmt.Println("Запрос на синхронизацию получен. Подготовка архива...")
 
@@ -313,26 +647,99 @@ func runServer(port string) {
 		w.Header().Set("Content-Type", "application/zip")
 		w.Header().Set("Content-Disposition", "attachment; filename=vscode_settings.zip")
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		archive := zip.NewWriter(w)
+
+		var dst io.Writer = w
+		var encWriter io.WriteCloser
+		if encKey != nil {
+			w.Header().Set("X-Sync-Encrypted", "1")
+			var err error
+			encWriter, err = syncenc.NewEncryptingWriter(w, encKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			dst = encWriter
+		}
+
+		archive := zip.NewWriter(dst)
 
 		// ВАЖНО: сначала закрываем архив (записывается центральный каталог ZIP),
-		// а потом обработчик завершает HTTP-сессию.
+		// потом — шифрующий writer, и только затем обработчик завершает HTTP-сессию.
+		if encWriter != nil {
+			defer encWriter.Close()
+		}
 		defer archive.Close()
 
-		// 2. Добавляем папки по очереди
-		// Конфиги полетят в папку "User" внутри архива
-		userDir := filepath.Join(os.Getenv("APPDATA"), "Code", "User")
-		addFolderToZip(userDir, "User", archive)
-
-		// Плагины полетят в папку "extensions" внутри архива
-		extDir := filepath.Join(os.Getenv("USERPROFILE"), ".vscode", "extensions")
-		addFolderToZip(extDir, "extensions", archive)
+		if files != nil {
+			if err := addFilesToZip(paths, activeProfile, files, archive); err != nil {
+				fmt.Printf("Ошибка при подготовке дельта-архива: %v\n", err)
+			}
+		} else {
+			// 2. Добавляем корни по очереди (User, extensions и profile.ExtraPaths)
+			skip := buildSkipFn(activeProfile)
+			for _, root := range syncRoots(paths, activeProfile) {
+				if err := addFolderToZip(root.Dir, root.Prefix, archive, skip); err != nil {
+					fmt.Printf("Ошибка при добавлении %s в архив: %v\n", root.Dir, err)
+				}
+			}
+		}
 
 		fmt.Println("Архив передан.")
 	})
 
+	return mux
+}
+
+func runServer(port string, flavor string, passphrase string, activeProfile *profile) {
+	paths, err := getVSCodePaths(flavor)
+	if err != nil {
+		fmt.Printf("Ошибка поиска папок VS Code: %v\n", err)
+		return
+	}
+
+	encKey, salt, err := deriveServerKey(passphrase, activeProfile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if encKey != nil {
+		fmt.Println("🔒 Шифрование включено (AES-256-GCM). На клиенте нужен тот же -passphrase / VSCSYNC_KEY.")
+	}
+
+	localIP := getLocalIP()
+	if localIP == "" {
+		fmt.Printf("Ошибка при старте сервера: не определен ip-адрес для подключения")
+		return
+	}
+
+	// Профиль может переопределить адрес прослушивания (bind: 0.0.0.0:8080 в config.yml) —
+	// тогда и порт в подсказке для клиента берется из bind; -port остается в подсказке,
+	// только если bind не разбирается как host:port.
+	listenAddr := ":" + port
+	displayPort := port
+	if activeProfile.Bind != "" {
+		listenAddr = activeProfile.Bind
+		if _, bindPort, err := net.SplitHostPort(activeProfile.Bind); err == nil {
+			displayPort = bindPort
+		}
+	}
+
+	displayAddr := fmt.Sprintf("%s:%s", localIP, displayPort)
+
+	fmt.Println("========================================")
+	fmt.Printf("✅ Сервер успешно запущен!\n")
+	if activeProfile.Name != "" {
+		fmt.Printf("Профиль: %s\n", activeProfile.Name)
+	}
+	fmt.Printf("На клиенте используйте команду:\n")
+	fmt.Printf("> vscode-settings-sync client %s\n", displayAddr)
+	fmt.Println("========================================")
+	fmt.Println("Ожидание подключений...")
+
+	mux := newSyncMux(paths, activeProfile, encKey, salt)
+
 	// Создаем сервер и запускаем в отдельной горутине
-	srv := &http.Server{Addr: ":" + port}
+	srv := &http.Server{Addr: listenAddr, Handler: mux}
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -358,89 +765,371 @@ func runServer(port string) {
 
 }
 
+// checkSyncAuth проверяет заголовок X-Sync-Auth: HMAC-SHA256(method+path+timestamp+filesDigest),
+// посчитанный тем же ключом, и что timestamp не старше maxAuthSkew (защита от replay).
+// files — список, уже разобранный из ?files= или POST-тела; он входит в подпись,
+// иначе перехваченную подпись можно переиграть с другим списком файлов.
+func checkSyncAuth(r *http.Request, key []byte, files []string) bool {
+	tsHeader := r.Header.Get("X-Sync-Timestamp")
+	authHeader := r.Header.Get("X-Sync-Auth")
+	if tsHeader == "" || authHeader == "" {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > maxAuthSkew || skew < -maxAuthSkew {
+		return false
+	}
+
+	got, err := hex.DecodeString(authHeader)
+	if err != nil {
+		return false
+	}
+
+	expected := syncenc.AuthHMAC(key, r.Method, r.URL.Path, ts, syncenc.FilesDigest(files))
+	return hmac.Equal(expected, got)
+}
+
 // --- КЛИЕНТСКАЯ ЧАСТЬ ---
 
-func runClient(serverIP string, port string) {
-	vscodePath, err := getVSCodePath()
+// runClient теперь работает дельта-синком: сначала сравнивает манифест сервера со
+// своим локальным деревом (paths.UserDir + paths.ExtensionsDir) и только потом
+// скачивает изменившиеся/новые файлы, а лишние удаляет. При dryRun ничего не
+// скачивается и не трогает диск — только печатается список изменений.
+func runClient(serverIP string, port string, flavor string, passphrase string, dryRun bool, activeProfile *profile) {
+	paths, err := getVSCodePaths(flavor)
 	if err != nil {
-		fmt.Printf("Ошибка поиска папки VS Code: %v\n", err)
+		fmt.Printf("Ошибка поиска папок VS Code: %v\n", err)
 		return
 	}
 
-	url := fmt.Sprintf("http://%s:%s/sync", serverIP, port)
-	fmt.Printf("Подключение к серверу: %s\n", url)
+	baseURL := fmt.Sprintf("http://%s:%s", serverIP, port)
+	fmt.Printf("Подключение к серверу: %s\n", baseURL)
+
+	if activeProfile.Name != "" {
+		remoteName, remoteHash, err := fetchProfileInfo(baseURL)
+		if err != nil {
+			fmt.Printf("Ошибка получения профиля с сервера: %v\n", err)
+			return
+		}
+		if remoteName != activeProfile.Name || remoteHash != profileHash(activeProfile) {
+			fmt.Printf("❌ Профиль сервера (%q) не совпадает с локальным профилем %q — синхронизация отменена, чтобы не перезаписать чужие настройки.\n", remoteName, activeProfile.Name)
+			return
+		}
+	}
+
+	var encKey []byte
+	if passphrase != "" {
+		salt, err := fetchSalt(baseURL)
+		if err != nil {
+			fmt.Printf("Ошибка получения соли шифрования с сервера: %v\n", err)
+			return
+		}
+		encKey = syncenc.DeriveKey(passphrase, salt)
+	}
 
-	resp, err := http.Get(url)
+	fmt.Println("Считаем локальный манифест...")
+	localManifest, err := buildManifest(paths, activeProfile)
 	if err != nil {
-		fmt.Printf("Ошибка подключения к серверу: %v\n", err)
+		fmt.Printf("Ошибка построения локального манифеста: %v\n", err)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Сервер вернул ошибку: %s\n", resp.Status)
+	fmt.Println("Запрашиваем манифест сервера...")
+	remoteManifest, err := fetchManifest(baseURL, encKey)
+	if err != nil {
+		fmt.Printf("Ошибка получения манифеста с сервера: %v\n", err)
+		return
+	}
+
+	diff := diffManifests(localManifest, remoteManifest)
+	if diff.IsEmpty() {
+		fmt.Println("✅ Настройки уже синхронизированы, изменений нет.")
+		return
+	}
+
+	fmt.Printf("Изменения: скачать %d файл(ов), удалить %d файл(ов).\n", len(diff.ToFetch), len(diff.ToDelete))
+	if dryRun {
+		fmt.Println("\n[dry-run] Скачать:")
+		for _, p := range diff.ToFetch {
+			fmt.Printf("  + %s\n", p)
+		}
+		fmt.Println("[dry-run] Удалить:")
+		for _, p := range diff.ToDelete {
+			fmt.Printf("  - %s\n", p)
+		}
+		fmt.Println("\n[dry-run] Ничего не изменено на диске.")
 		return
 	}
 
 	// СОЗДАНИЕ БЭКАПА
 	// Если бэкап не удается - ОСТАНАВЛИВАЕМ выполнение.
 	// Мы не хотим перезаписывать настройки без страховки.
-	if err := backupDir(vscodePath); err != nil {
-		fmt.Printf("❌ ОШИБКА БЭКАПА: %v\n", err)
-		fmt.Println("⛔  ВАЖНО: Операция синхронизации ОТМЕНЕНА для безопасности.")
-		fmt.Println("Возможно, VS Code или другой процесс заблокировали папку.")
-		fmt.Println("1. Закройте VS Code.")
-		fmt.Println("2. Проверьте диспетчер задач на наличие процессов Code.exe.")
-		fmt.Println("3. Попробуйте снова.")
+	for _, root := range syncRoots(paths, activeProfile) {
+		if err := backupDir(root.Dir); err != nil {
+			fmt.Printf("❌ ОШИБКА БЭКАПА (%s): %v\n", root.Dir, err)
+			fmt.Println("⛔  ВАЖНО: Операция синхронизации ОТМЕНЕНА для безопасности.")
+			fmt.Println("Возможно, VS Code или другой процесс заблокировали папку.")
+			fmt.Println("1. Закройте VS Code.")
+			fmt.Println("2. Проверьте диспетчер задач на наличие процессов Code.exe.")
+			fmt.Println("3. Попробуйте снова.")
+			return
+		}
+	}
+
+	fmt.Println("✅ Бэкап создан успешно. Скачивание изменившихся файлов...")
+	body, err := fetchSyncFiles(baseURL, encKey, diff.ToFetch)
+	if err != nil {
+		fmt.Printf("Ошибка скачивания изменений: %v\n", err)
 		return
 	}
+	defer body.Close()
 
-	fmt.Println("✅ Бэкап создан успешно. Распаковка новых настроек...")
-	if err := unzipDest(resp.Body, vscodePath); err != nil {
-		fmt.Printf("Ошибка распаковки: %v\n", err)
+	if err := applyDelta(paths, body, diff, activeProfile); err != nil {
+		fmt.Printf("Ошибка применения изменений: %v\n", err)
 		return
 	}
 
 	fmt.Println("🎉 Синхронизация успешно завершена! Перезапустите VS Code.")
 }
 
+// fetchSalt забирает соль шифрования с сервера (открытый, неаутентифицированный запрос).
+func fetchSalt(baseURL string) ([]byte, error) {
+	resp, err := http.Get(baseURL + "/salt")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("сервер вернул %s (шифрование включено на сервере?)", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// fetchProfileInfo забирает имя и хэш активного профиля сервера (/profile, открытый
+// эндпоинт) — клиент сверяет их со своим локальным профилем перед синхронизацией.
+func fetchProfileInfo(baseURL string) (name string, hash string, err error) {
+	resp, err := http.Get(baseURL + "/profile")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("сервер вернул %s", resp.Status)
+	}
+
+	var payload struct {
+		Name string `json:"name"`
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", "", err
+	}
+	return payload.Name, payload.Hash, nil
+}
+
+// authenticatedRequest готовит GET-запрос к path (без query) на baseURL и, если
+// encKey задан, подписывает его заголовками X-Sync-Auth/X-Sync-Timestamp. files —
+// список, запрашиваемый через query (тот же, что лег в query), включается в подпись,
+// чтобы перехваченный запрос нельзя было переиграть с другим списком файлов.
+func authenticatedRequest(baseURL, path, query string, encKey []byte, files []string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, baseURL+path+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if encKey != nil {
+		ts := time.Now().Unix()
+		mac := syncenc.AuthHMAC(encKey, http.MethodGet, path, ts, syncenc.FilesDigest(files))
+		req.Header.Set("X-Sync-Timestamp", strconv.FormatInt(ts, 10))
+		req.Header.Set("X-Sync-Auth", hex.EncodeToString(mac))
+	}
+	return req, nil
+}
+
+// fetchManifest забирает JSON-манифест сервера (/manifest).
+func fetchManifest(baseURL string, encKey []byte) ([]manifestEntry, error) {
+	req, err := authenticatedRequest(baseURL, "/manifest", "", encKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("сервер вернул %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalManifest(data)
+}
+
+// syncBody оборачивает тело ответа /sync вместе с (возможным) расшифровывающим
+// Reader'ом, чтобы вызывающий код мог закрыть исходное HTTP-соединение через Close.
+type syncBody struct {
+	io.Reader
+	underlying io.Closer
+}
+
+func (b *syncBody) Close() error {
+	return b.underlying.Close()
+}
+
+// fetchSyncFiles запрашивает у сервера архив только с перечисленными files
+// (/sync?files=...) и проверяет, что шифрование ответа соответствует ожиданиям клиента.
+func fetchSyncFiles(baseURL string, encKey []byte, files []string) (io.ReadCloser, error) {
+	query := "?files=" + url.QueryEscape(strings.Join(files, ","))
+	req, err := authenticatedRequest(baseURL, "/sync", query, encKey, files)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("сервер вернул %s", resp.Status)
+	}
+
+	serverEncrypted := resp.Header.Get("X-Sync-Encrypted") == "1"
+	if encKey != nil && !serverEncrypted {
+		resp.Body.Close()
+		return nil, fmt.Errorf("сервер ответил без шифрования, хотя -passphrase задан на клиенте")
+	}
+	if encKey == nil && serverEncrypted {
+		resp.Body.Close()
+		return nil, fmt.Errorf("сервер требует passphrase (ответ зашифрован), а на клиенте он не задан")
+	}
+
+	var body io.Reader = resp.Body
+	if encKey != nil {
+		body, err = syncenc.NewDecryptingReader(resp.Body, encKey)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return &syncBody{Reader: body, underlying: resp.Body}, nil
+}
+
+// resolvePassphrase берет -passphrase, а если флаг не задан — переменную окружения VSCSYNC_KEY.
+func resolvePassphrase(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(EnvPassphrase)
+}
+
 // --- MAIN ---
 
+// cliArgs — результат разбора флагов и позиционных аргументов командной строки
+// (команда server/client и IP сервера для client).
+type cliArgs struct {
+	port       string
+	flavor     string
+	passphrase string
+	dryRun     bool
+	config     string
+	profile    string
+	command    string
+	ip         string
+}
+
+// parseCLIArgs разбирает args (без имени программы, т.е. os.Args[1:]) через
+// отдельный *flag.FlagSet — в отличие от пакетного flag.Parse(), это позволяет
+// звать функцию из тестов сколько угодно раз без общего состояния. Флаги должны
+// идти перед командой: flag.FlagSet.Parse, как и пакетный flag.Parse, стоит на
+// первом не-флаговом аргументе, и то, что после него (команда, IP), оказывается
+// в fs.Args()/fs.Arg(N), а не разбирается как флаги.
+func parseCLIArgs(args []string) (*cliArgs, error) {
+	fs := flag.NewFlagSet("vscode-settings-sync", flag.ContinueOnError)
+	c := &cliArgs{}
+	fs.StringVar(&c.port, "port", DEFAULT_PORT, "Порт для работы сервера/клиента")
+	fs.StringVar(&c.flavor, "flavor", FlavorStable, "Какую установку VS Code синхронизировать: stable|insiders|oss|server")
+	fs.StringVar(&c.passphrase, "passphrase", "", "Пароль для AES-256-GCM шифрования трафика (или переменная окружения VSCSYNC_KEY)")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "Клиент: только показать, что изменилось бы, не трогая диск")
+	fs.StringVar(&c.config, "config", "", "Путь к config.yml с профилями (по умолчанию ~/.config/vscode-settings-sync/config.yml)")
+	fs.StringVar(&c.profile, "profile", "", "Имя профиля из config.yml (include/exclude/extra_paths/encrypt/bind)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.command = fs.Arg(0)
+	if fs.NArg() > 1 {
+		c.ip = fs.Arg(1)
+	}
+	return c, nil
+}
+
+func printUsage() {
+	fmt.Println("Использование:")
+	fmt.Println("  Сервер: vscode-settings-sync [-port ПОРТ] [-flavor stable|insiders|oss|server] [-profile ИМЯ] server")
+	fmt.Println("  Клиент: vscode-settings-sync [-port ПОРТ] [-dry-run] [-profile ИМЯ] client <IP-адрес-сервера>")
+	fmt.Println("\nПримеры:")
+	fmt.Println("  vscode-settings-sync server")
+	fmt.Println("  vscode-settings-sync -flavor insiders server")
+	fmt.Println("  vscode-settings-sync -port 9000 client 192.168.1.50")
+	fmt.Println("  vscode-settings-sync -dry-run client 192.168.1.50")
+	fmt.Println("  vscode-settings-sync -profile work server")
+	fmt.Println("  vscode-settings-sync -config ~/work-config.yml -profile work client 192.168.1.50")
+	fmt.Println("\nПо умолчанию используется порт 8080, flavor stable и синхронизируется все дерево (без -profile).")
+}
+
 func main() {
-	// Определяем флаг для порта
-	// flag.String возвращает *string (указатель).
-	portPtr := flag.String("port", DEFAULT_PORT, "Порт для работы сервера/клиента")
-	flag.Parse() // Парсим флаги, которые пользователь передал при запуске
-
-	// После flag.Parse оставшиеся аргументы лежат в os.Args
-	// os.Args[0] - имя программы
-	// os.Args[1] - первая команда (server/client), если есть.
-	// os.Args[2] - вторая команда (IP), если есть.
-
-	if len(os.Args) < 2 {
-		fmt.Println("Использование:")
-		fmt.Println("  Сервер: vscode-settings-sync [-port ПОРТ] server")
-		fmt.Println("  Клиент: vscode-settings-sync [-port ПОРТ] client <IP-адрес-сервера>")
-		fmt.Println("\nПримеры:")
-		fmt.Println("  vscode-settings-sync server")
-		fmt.Println("  vscode-settings-sync -port 9000 client 192.168.1.50")
-		fmt.Println("\nПо умолчанию используется порт 8080.")
+	c, err := parseCLIArgs(os.Args[1:])
+	if err != nil {
+		return // flag.FlagSet уже напечатал причину и usage флагов
+	}
+
+	if c.command == "" {
+		printUsage()
 		return
 	}
 
-	command := os.Args[1]
+	switch c.flavor {
+	case FlavorStable, FlavorInsiders, FlavorOSS, FlavorServer:
+		// ок
+	default:
+		fmt.Printf("Неизвестный flavor %q. Допустимые значения: stable, insiders, oss, server.\n", c.flavor)
+		return
+	}
+
+	passphrase := resolvePassphrase(c.passphrase)
+
+	activeProfile, err := loadProfile(c.config, c.profile)
+	if err != nil {
+		fmt.Printf("Ошибка загрузки профиля: %v\n", err)
+		return
+	}
 
-	switch command {
+	switch c.command {
 	case "server":
-		runServer(*portPtr)
+		runServer(c.port, c.flavor, passphrase, activeProfile)
 	case "client":
-		if len(os.Args) < 3 {
+		if c.ip == "" {
 			fmt.Println("Ошибка: укажите IP адрес сервера.")
 			fmt.Println("Пример: vscode-settings-sync client 192.168.1.50")
 			return
 		}
-		ip := os.Args[2]
-		runClient(ip, *portPtr)
+		runClient(c.ip, c.port, c.flavor, passphrase, c.dryRun, activeProfile)
 	default:
 		fmt.Println("Неизвестная команда. Используйте 'server' или 'client'.")
 	}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestEntry описывает один файл в составе синхронизируемого дерева (User + extensions),
+// как его отдает /manifest и как его считает клиент для локального дерева.
+type manifestEntry struct {
+	Path    string      `json:"path"` // архивный путь, напр. "User/settings.json"
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"` // unix-секунды
+	SHA256  string      `json:"sha256"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// buildManifest обходит корни синхронизации (User, extensions и profile.ExtraPaths —
+// см. syncRoots) теми же правилами отбора, что и addFolderToZip (buildSkipFn), и
+// считает sha256 каждого файла. Используется и сервером (для /manifest), и клиентом
+// (чтобы сравнить локальное дерево с удаленным).
+func buildManifest(paths *vscodePaths, p *profile) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	skip := buildSkipFn(p)
+
+	for _, root := range syncRoots(paths, p) {
+		if _, err := os.Stat(root.Dir); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.WalkDir(root.Dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root.Dir, path)
+			if err != nil {
+				return err
+			}
+			if skip(rel) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			sum, err := sha256File(path)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, manifestEntry{
+				Path:    filepath.ToSlash(filepath.Join(root.Prefix, rel)),
+				Size:    info.Size(),
+				ModTime: info.ModTime().Unix(),
+				SHA256:  sum,
+				Mode:    info.Mode(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestDiff — результат сравнения локального манифеста с тем, что прислал сервер.
+type manifestDiff struct {
+	ToFetch  []string // архивные пути, которых нет локально или они отличаются — нужно скачать
+	ToDelete []string // архивные пути, которых больше нет на сервере — удалить локально
+}
+
+func (d manifestDiff) IsEmpty() bool {
+	return len(d.ToFetch) == 0 && len(d.ToDelete) == 0
+}
+
+// diffManifests сравнивает local (то, что реально лежит на диске у клиента) с remote
+// (тем, что вернул сервер по /manifest).
+func diffManifests(local, remote []manifestEntry) manifestDiff {
+	localByPath := make(map[string]manifestEntry, len(local))
+	for _, e := range local {
+		localByPath[e.Path] = e
+	}
+	remoteByPath := make(map[string]manifestEntry, len(remote))
+	for _, e := range remote {
+		remoteByPath[e.Path] = e
+	}
+
+	var diff manifestDiff
+	for _, r := range remote {
+		l, ok := localByPath[r.Path]
+		if !ok || l.SHA256 != r.SHA256 || l.Size != r.Size {
+			diff.ToFetch = append(diff.ToFetch, r.Path)
+		}
+	}
+	for _, l := range local {
+		if _, ok := remoteByPath[l.Path]; !ok {
+			diff.ToDelete = append(diff.ToDelete, l.Path)
+		}
+	}
+
+	sort.Strings(diff.ToFetch)
+	sort.Strings(diff.ToDelete)
+	return diff
+}
+
+func marshalManifest(entries []manifestEntry) ([]byte, error) {
+	return json.Marshal(entries)
+}
+
+func unmarshalManifest(data []byte) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("не удалось разобрать манифест: %w", err)
+	}
+	return entries, nil
+}
+
+// applyDelta накатывает результат дельта-синка: zipBody содержит только
+// измененные/новые файлы (по именам из diff.ToFetch), а diff.ToDelete — архивные
+// пути, которых больше нет на сервере. Для каждого корня (UserDir, ExtensionsDir)
+// строится staging-копия текущего состояния (через дешевый hardlinkSnapshot),
+// в неё накладываются изменения и удаления, после чего staging атомарно
+// подменяет исходную директорию — как и при полной синхронизации (см. unzipDest).
+func applyDelta(paths *vscodePaths, zipBody io.Reader, diff manifestDiff, p *profile) error {
+	tmpZip, err := os.CreateTemp("", "vscsync-delta-*.zip")
+	if err != nil {
+		return fmt.Errorf("не удалось создать временный файл архива: %w", err)
+	}
+	tmpZipPath := tmpZip.Name()
+	defer os.Remove(tmpZipPath)
+
+	_, copyErr := io.Copy(tmpZip, zipBody)
+	closeErr := tmpZip.Close()
+	if copyErr != nil {
+		return fmt.Errorf("не удалось сохранить архив во временный файл: %w", copyErr)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	zr, err := zip.OpenReader(tmpZipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, root := range syncRoots(paths, p) {
+		if err := applyDeltaToRoot(root.Dir, root.Prefix, zr.File, diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesRoot проверяет, относится ли archivePath (из ToDelete/files) к корню с
+// данным prefix — либо как содержимое поддиректории ("User/settings.json"), либо,
+// для файловых extra_paths-корней вроде ".gitconfig", как сам корень целиком
+// (archivePath == prefix, без компонента пути после него).
+func matchesRoot(archivePath, prefix string) bool {
+	return archivePath == prefix || strings.HasPrefix(archivePath, prefix+"/")
+}
+
+// relToRoot возвращает путь archivePath относительно prefix ("" для archivePath == prefix).
+func relToRoot(archivePath, prefix string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(archivePath, prefix), "/")
+}
+
+// applyDeltaToRoot применяет изменения, относящиеся к одному корню (rootDir,
+// с архивным префиксом prefix — "User", "extensions" или файловый/директорный
+// extra_paths-корень из config.yml). Файловые корни (rootDir — не каталог, а один
+// файл, например ".gitconfig") ведут себя иначе, чем деревья User/extensions:
+// для них staging-директория и hardlinkSnapshot не подходят, см. applyFileRootDelta.
+func applyDeltaToRoot(rootDir, prefix string, files []*zip.File, diff manifestDiff) error {
+	existing, statErr := os.Stat(rootDir)
+	switch {
+	case statErr == nil && !existing.IsDir():
+		// rootDir уже существует и это не каталог — корень файловый.
+		return applyFileRootDelta(rootDir, prefix, files, diff)
+	case statErr == nil:
+		// rootDir уже существует как каталог (User/extensions или directory-тип
+		// extra_paths) — остается деревом, даже если archivePath у файлового
+		// extra_paths-корня с совпадающим по ошибке префиксом попал в эту дельту.
+	case os.IsNotExist(statErr):
+		if findExactEntry(files, prefix) != nil || containsExact(diff.ToDelete, prefix) {
+			return applyFileRootDelta(rootDir, prefix, files, diff)
+		}
+	default:
+		return statErr
+	}
+
+	parent := filepath.Dir(rootDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(parent, ".vscsync-staging-*")
+	if err != nil {
+		return fmt.Errorf("не удалось создать staging-директорию: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	// 1. Переносим то, что уже есть, дешево — через hardlink (если возможно)
+	if _, err := os.Stat(rootDir); err == nil {
+		if err := hardlinkSnapshot(rootDir, staging); err != nil {
+			return fmt.Errorf("не удалось скопировать текущее состояние %s: %w", rootDir, err)
+		}
+	}
+
+	stagingCanon, err := filepath.EvalSymlinks(staging)
+	if err != nil {
+		return fmt.Errorf("не удалось канонизировать staging-директорию: %w", err)
+	}
+
+	// 2. Убираем из staging файлы, которых больше нет на сервере
+	for _, archivePath := range diff.ToDelete {
+		if !matchesRoot(archivePath, prefix) {
+			continue
+		}
+		rel := relToRoot(archivePath, prefix)
+		if err := os.RemoveAll(filepath.Join(stagingCanon, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+
+	// 3. Накладываем скачанные изменения этого корня
+	for _, f := range files {
+		if !matchesRoot(f.Name, prefix) {
+			continue
+		}
+		rel := relToRoot(f.Name, prefix)
+		if err := extractZipEntryNamed(f, rel, stagingCanon); err != nil {
+			return err
+		}
+	}
+
+	// 4. Атомарно подменяем rootDir собранным staging
+	if _, err := os.Stat(rootDir); err == nil {
+		if err := os.RemoveAll(rootDir); err != nil {
+			return fmt.Errorf("не удалось освободить место под %s: %w", rootDir, err)
+		}
+	}
+	return os.Rename(staging, rootDir)
+}
+
+// findExactEntry ищет среди скачанных файлов запись, архивный путь которой равен
+// prefix целиком (т.е. этот корень — сам файл, а не каталог с содержимым).
+func findExactEntry(files []*zip.File, prefix string) *zip.File {
+	for _, f := range files {
+		if f.Name == prefix {
+			return f
+		}
+	}
+	return nil
+}
+
+// containsExact — есть ли в list запись, равная target целиком.
+func containsExact(list []string, target string) bool {
+	for _, v := range list {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFileRootDelta обрабатывает файловый extra_paths-корень (rootDir — один файл,
+// а не дерево, например ".gitconfig"). В отличие от User/extensions, для него
+// staging-директория и поэлементный hardlinkSnapshot не имеют смысла: подмена идет
+// через staging-директорию с единственной записью и os.Rename этой записи поверх
+// rootDir, что сохраняет ту же гарантию атомарности, что и у applyDeltaToRoot.
+func applyFileRootDelta(rootDir, prefix string, files []*zip.File, diff manifestDiff) error {
+	if containsExact(diff.ToDelete, prefix) {
+		if err := os.Remove(rootDir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	fetched := findExactEntry(files, prefix)
+	if fetched == nil {
+		// Этот корень не менялся в данном синке — оставляем как есть.
+		return nil
+	}
+
+	parent := filepath.Dir(rootDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(parent, ".vscsync-staging-*")
+	if err != nil {
+		return fmt.Errorf("не удалось создать staging-директорию: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	stagingCanon, err := filepath.EvalSymlinks(staging)
+	if err != nil {
+		return fmt.Errorf("не удалось канонизировать staging-директорию: %w", err)
+	}
+
+	name := filepath.Base(prefix)
+	if err := extractZipEntryNamed(fetched, name, stagingCanon); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(rootDir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("не удалось освободить место под %s: %w", rootDir, err)
+	}
+	return os.Rename(filepath.Join(stagingCanon, name), rootDir)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// --- shouldSkip: таблица случаев ---
+
+func TestShouldSkip(t *testing.T) {
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"settings.json", false},
+		{"keybindings.json", false},
+		{filepath.Join("snippets", "go.json"), false},
+		{filepath.Join("Cache", "x"), true},
+		{filepath.Join("CachedData", "1.0", "x"), true},
+		{filepath.Join("Code Cache", "x"), true},
+		{filepath.Join("logs", "main.log"), true},
+		{filepath.Join("workspaceStorage", "abc", "state.vscdb"), true},
+		{filepath.Join("globalStorage", "github.copilot", "state.json"), true},
+		{"foo.sock", true},
+		{filepath.Join("globalStorage", "state-journal"), true},
+	}
+
+	for _, tc := range cases {
+		if got := shouldSkip(tc.path); got != tc.want {
+			t.Errorf("shouldSkip(%q) = %v, хотим %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+// --- parseCLIArgs: флаги должны идти перед командой и реально доходить до нее ---
+// (flag.Parse останавливается на первом не-флаговом аргументе, так что команда и
+// позиционные аргументы читаются из fs.Args()/fs.Arg(N), а не из os.Args)
+
+func TestParseCLIArgsFlavorBeforeCommand(t *testing.T) {
+	got, err := parseCLIArgs([]string{"-flavor", "insiders", "server"})
+	if err != nil {
+		t.Fatalf("parseCLIArgs: %v", err)
+	}
+	want := cliArgs{port: DEFAULT_PORT, flavor: FlavorInsiders, command: "server"}
+	if *got != want {
+		t.Errorf("parseCLIArgs = %+v, хотим %+v", *got, want)
+	}
+}
+
+func TestParseCLIArgsNoCommand(t *testing.T) {
+	got, err := parseCLIArgs([]string{"-flavor", "insiders"})
+	if err != nil {
+		t.Fatalf("parseCLIArgs: %v", err)
+	}
+	if got.command != "" {
+		t.Fatalf("команда не указана, ожидали пустой command, получили %q", got.command)
+	}
+}
+
+func TestParseCLIArgsPassphraseBeforeCommand(t *testing.T) {
+	got, err := parseCLIArgs([]string{"-passphrase", "secret", "server"})
+	if err != nil {
+		t.Fatalf("parseCLIArgs: %v", err)
+	}
+	want := cliArgs{port: DEFAULT_PORT, flavor: FlavorStable, passphrase: "secret", command: "server"}
+	if *got != want {
+		t.Errorf("parseCLIArgs = %+v, хотим %+v", *got, want)
+	}
+}
+
+func TestParseCLIArgsDryRunBeforeCommand(t *testing.T) {
+	got, err := parseCLIArgs([]string{"-dry-run", "client", "1.2.3.4"})
+	if err != nil {
+		t.Fatalf("parseCLIArgs: %v", err)
+	}
+	want := cliArgs{port: DEFAULT_PORT, flavor: FlavorStable, dryRun: true, command: "client", ip: "1.2.3.4"}
+	if *got != want {
+		t.Errorf("parseCLIArgs = %+v, хотим %+v", *got, want)
+	}
+}
+
+func TestParseCLIArgsConfigAndProfileBeforeCommand(t *testing.T) {
+	got, err := parseCLIArgs([]string{"-config", "/tmp/x.yml", "-profile", "work", "server"})
+	if err != nil {
+		t.Fatalf("parseCLIArgs: %v", err)
+	}
+	want := cliArgs{port: DEFAULT_PORT, flavor: FlavorStable, config: "/tmp/x.yml", profile: "work", command: "server"}
+	if *got != want {
+		t.Errorf("parseCLIArgs = %+v, хотим %+v", *got, want)
+	}
+}
+
+// --- getVSCodePaths: пути должны резолвиться через $HOME, что дает тестам
+// полную изоляцию через t.Setenv, без разделяемого состояния между кейсами ---
+
+func TestGetVSCodePathsInjectableViaHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("тест рассчитан на резолюцию через $HOME (linux/darwin)")
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	paths, err := getVSCodePaths(FlavorStable)
+	if err != nil {
+		t.Fatalf("getVSCodePaths: %v", err)
+	}
+	if !containsPrefix(paths.UserDir, home) || !containsPrefix(paths.ExtensionsDir, home) {
+		t.Fatalf("пути должны быть внутри временного HOME %s, получили %+v", home, paths)
+	}
+
+	insiders, err := getVSCodePaths(FlavorInsiders)
+	if err != nil {
+		t.Fatalf("getVSCodePaths(insiders): %v", err)
+	}
+	if insiders.UserDir == paths.UserDir {
+		t.Fatalf("stable и insiders не должны делить один и тот же UserDir")
+	}
+}
+
+func containsPrefix(path, prefix string) bool {
+	return strings.HasPrefix(path, prefix+string(os.PathSeparator))
+}
+
+// --- вспомогательные функции для фикстур и ручной сборки zip ---
+
+type fixtureFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+}
+
+// writeFixtureTree создает дерево User/extensions во временной директории: обычные
+// файлы настроек вперемешку с тем, что должно быть отфильтровано shouldSkip.
+func writeFixtureTree(t *testing.T) *vscodePaths {
+	t.Helper()
+	base := t.TempDir()
+	paths := &vscodePaths{
+		UserDir:       filepath.Join(base, "User"),
+		ExtensionsDir: filepath.Join(base, "extensions"),
+	}
+
+	files := []fixtureFile{
+		{filepath.Join(paths.UserDir, "settings.json"), `{"editor.fontSize": 14}`, 0644},
+		{filepath.Join(paths.UserDir, "keybindings.json"), `[]`, 0644},
+		{filepath.Join(paths.UserDir, "snippets", "go.json"), `{}`, 0644},
+		{filepath.Join(paths.UserDir, "Cache", "x"), "junk", 0644},
+		{filepath.Join(paths.UserDir, "logs", "main.log"), "junk", 0644},
+		{filepath.Join(paths.UserDir, "foo.sock"), "junk", 0644},
+		{filepath.Join(paths.ExtensionsDir, "publisher.ext-1.0.0", "package.json"), `{"name":"ext"}`, 0644},
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(f.path, []byte(f.content), f.mode); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return paths
+}
+
+type zipEntry struct {
+	name       string
+	content    string
+	symlinkTo  string // если непусто, записывается как symlink-запись с этим содержимым-целью
+	headerMode os.FileMode
+}
+
+// mustBuildZip вручную собирает zip-архив из entries — используется для того, чтобы
+// смоделировать вредоносные архивы (ZipSlip, симлинки, абсолютные пути), которые
+// нормальный addFolderToZip никогда бы не породил.
+func mustBuildZip(entries []zipEntry) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		switch {
+		case e.symlinkTo != "":
+			header.SetMode(os.ModeSymlink | 0777)
+		case e.headerMode != 0:
+			header.SetMode(e.headerMode)
+		default:
+			header.SetMode(0644)
+		}
+
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			panic(err)
+		}
+		content := e.content
+		if e.symlinkTo != "" {
+			content = e.symlinkTo
+		}
+		if _, err := fw.Write([]byte(content)); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// --- unzipDest: защита от ZipSlip / симлинков / абсолютных путей ---
+
+func TestUnzipDestRejectsZipSlip(t *testing.T) {
+	data := mustBuildZip([]zipEntry{
+		{name: "../../etc/passwd", content: "pwned"},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := unzipDest(bytes.NewReader(data), dest); err == nil {
+		t.Fatal("ожидали ошибку на ZipSlip-путь, получили nil")
+	}
+}
+
+func TestUnzipDestRejectsSymlink(t *testing.T) {
+	data := mustBuildZip([]zipEntry{
+		{name: "settings.json", symlinkTo: "/etc/passwd"},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := unzipDest(bytes.NewReader(data), dest); err == nil {
+		t.Fatal("ожидали ошибку на символьную ссылку в архиве, получили nil")
+	}
+}
+
+func TestUnzipDestRejectsAbsolutePath(t *testing.T) {
+	data := mustBuildZip([]zipEntry{
+		{name: "/etc/passwd", content: "pwned"},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := unzipDest(bytes.NewReader(data), dest); err == nil {
+		t.Fatal("ожидали ошибку на абсолютный путь в архиве, получили nil")
+	}
+}
+
+func TestUnzipDestRejectsWindowsDriveLetter(t *testing.T) {
+	data := mustBuildZip([]zipEntry{
+		{name: `C:\Windows\System32\evil.dll`, content: "pwned"},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := unzipDest(bytes.NewReader(data), dest); err == nil {
+		t.Fatal("ожидали ошибку на путь с буквой диска Windows, получили nil")
+	}
+}
+
+func TestUnzipDestAcceptsValidArchive(t *testing.T) {
+	data := mustBuildZip([]zipEntry{
+		{name: "User/settings.json", content: `{}`},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := unzipDest(bytes.NewReader(data), dest); err != nil {
+		t.Fatalf("валидный архив не должен отклоняться: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "User", "settings.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != `{}` {
+		t.Fatalf("содержимое файла = %q, хотим %q", got, `{}`)
+	}
+}
+
+// FuzzUnzipDest проверяет, что unzipDest не паникует на произвольных байтах,
+// выдаваемых за zip-архив.
+func FuzzUnzipDest(f *testing.F) {
+	f.Add(mustBuildZip([]zipEntry{{name: "User/settings.json", content: "{}"}}))
+	f.Add([]byte("не zip вообще"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dest := filepath.Join(t.TempDir(), "dest")
+		_ = unzipDest(bytes.NewReader(data), dest)
+	})
+}
+
+// --- полный HTTP roundtrip: сервер на фикстуре -> дельта-синк клиента во вторую директорию ---
+
+func TestSyncRoundtripOverHTTP(t *testing.T) {
+	serverPaths := writeFixtureTree(t)
+	mux := newSyncMux(serverPaths, &profile{}, nil, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	clientBase := t.TempDir()
+	clientPaths := &vscodePaths{
+		UserDir:       filepath.Join(clientBase, "User"),
+		ExtensionsDir: filepath.Join(clientBase, "extensions"),
+	}
+
+	localManifest, err := buildManifest(clientPaths, nil)
+	if err != nil {
+		t.Fatalf("buildManifest(client): %v", err)
+	}
+	if len(localManifest) != 0 {
+		t.Fatalf("локальное дерево клиента должно быть пустым до первого синка, получили %d записей", len(localManifest))
+	}
+
+	remoteManifest, err := fetchManifest(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("fetchManifest: %v", err)
+	}
+
+	diff := diffManifests(localManifest, remoteManifest)
+	if diff.IsEmpty() {
+		t.Fatal("ожидали непустой diff при первой синхронизации")
+	}
+
+	body, err := fetchSyncFiles(srv.URL, nil, diff.ToFetch)
+	if err != nil {
+		t.Fatalf("fetchSyncFiles: %v", err)
+	}
+	defer body.Close()
+
+	if err := applyDelta(clientPaths, body, diff, nil); err != nil {
+		t.Fatalf("applyDelta: %v", err)
+	}
+
+	// Проверяем, что применилось ожидаемое дерево и что мусор (Cache/logs/*.sock) не утек.
+	wantFiles := []string{
+		filepath.Join(clientPaths.UserDir, "settings.json"),
+		filepath.Join(clientPaths.UserDir, "keybindings.json"),
+		filepath.Join(clientPaths.UserDir, "snippets", "go.json"),
+		filepath.Join(clientPaths.ExtensionsDir, "publisher.ext-1.0.0", "package.json"),
+	}
+	for _, f := range wantFiles {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("ожидали файл %s после синхронизации: %v", f, err)
+		}
+	}
+
+	unwantedDirs := []string{
+		filepath.Join(clientPaths.UserDir, "Cache"),
+		filepath.Join(clientPaths.UserDir, "logs"),
+	}
+	for _, d := range unwantedDirs {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			t.Errorf("директория %s должна была быть отфильтрована shouldSkip", d)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(clientPaths.UserDir, "foo.sock")); !os.IsNotExist(err) {
+		t.Error("foo.sock должен был быть отфильтрован shouldSkip")
+	}
+
+	// Повторная синхронизация без изменений на сервере не должна находить diff.
+	localManifest2, err := buildManifest(clientPaths, nil)
+	if err != nil {
+		t.Fatalf("buildManifest(client, 2-й проход): %v", err)
+	}
+	diff2 := diffManifests(localManifest2, remoteManifest)
+	if !diff2.IsEmpty() {
+		t.Fatalf("повторная синхронизация без изменений не должна давать diff, получили %+v", diff2)
+	}
+}
+
+// --- дельта-синк для файлового extra_paths-корня (например, ".gitconfig") ---
+
+// TestApplyDeltaToRootFileTypeExtraPath воспроизводит баг из review: extra_paths-корень,
+// указывающий на отдельный файл (а не каталог), ранее терялся при сопоставлении
+// архивного пути с префиксом (strings.HasPrefix требовал "/" после префикса), из-за
+// чего файл заменялся пустой директорией при первом синке и синк падал при повторном.
+func TestApplyDeltaToRootFileTypeExtraPath(t *testing.T) {
+	serverHome := t.TempDir()
+	serverFile := filepath.Join(serverHome, ".gitconfig")
+	if err := os.WriteFile(serverFile, []byte("[user]\n\tname = Art\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	serverPaths := &vscodePaths{
+		UserDir:       filepath.Join(serverHome, "User"),
+		ExtensionsDir: filepath.Join(serverHome, "extensions"),
+	}
+	p := &profile{ExtraPaths: []extraPath{{Prefix: "gitconfig", Path: serverFile}}}
+
+	remoteManifest, err := buildManifest(serverPaths, p)
+	if err != nil {
+		t.Fatalf("buildManifest(server): %v", err)
+	}
+	mux := newSyncMux(serverPaths, p, nil, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	clientHome := t.TempDir()
+	clientFile := filepath.Join(clientHome, ".gitconfig")
+	clientPaths := &vscodePaths{
+		UserDir:       filepath.Join(clientHome, "User"),
+		ExtensionsDir: filepath.Join(clientHome, "extensions"),
+	}
+	clientProfile := &profile{ExtraPaths: []extraPath{{Prefix: "gitconfig", Path: clientFile}}}
+
+	// 1. Первая синхронизация: на клиенте .gitconfig еще не существует.
+	diff := diffManifests(nil, remoteManifest)
+	if !containsExact(diff.ToFetch, "gitconfig") {
+		t.Fatalf("ожидали 'gitconfig' в ToFetch, получили %+v", diff.ToFetch)
+	}
+	body, err := fetchSyncFiles(srv.URL, nil, diff.ToFetch)
+	if err != nil {
+		t.Fatalf("fetchSyncFiles: %v", err)
+	}
+	if err := applyDelta(clientPaths, body, diff, clientProfile); err != nil {
+		t.Fatalf("applyDelta (первый синк): %v", err)
+	}
+	body.Close()
+
+	info, err := os.Stat(clientFile)
+	if err != nil {
+		t.Fatalf(".gitconfig должен был появиться на клиенте: %v", err)
+	}
+	if info.IsDir() {
+		t.Fatal(".gitconfig превратился в пустую директорию вместо файла")
+	}
+	got, err := os.ReadFile(clientFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != "[user]\n\tname = Art\n" {
+		t.Fatalf("содержимое .gitconfig = %q, не совпадает с сервером", got)
+	}
+
+	// 2. Повторная синхронизация после изменения файла на сервере — клиент уже
+	// имеет локальный .gitconfig, и применение дельты поверх существующего файла не должно падать.
+	if err := os.WriteFile(serverFile, []byte("[user]\n\tname = Art2\n"), 0644); err != nil {
+		t.Fatalf("WriteFile (обновление на сервере): %v", err)
+	}
+	remoteManifest2, err := buildManifest(serverPaths, p)
+	if err != nil {
+		t.Fatalf("buildManifest(server, 2-й проход): %v", err)
+	}
+	localManifest2, err := buildManifest(clientPaths, clientProfile)
+	if err != nil {
+		t.Fatalf("buildManifest(client, 2-й проход): %v", err)
+	}
+	diff2 := diffManifests(localManifest2, remoteManifest2)
+	if !containsExact(diff2.ToFetch, "gitconfig") {
+		t.Fatalf("ожидали 'gitconfig' в ToFetch после обновления на сервере, получили %+v", diff2.ToFetch)
+	}
+	body2, err := fetchSyncFiles(srv.URL, nil, diff2.ToFetch)
+	if err != nil {
+		t.Fatalf("fetchSyncFiles (2-й проход): %v", err)
+	}
+	defer body2.Close()
+	if err := applyDelta(clientPaths, body2, diff2, clientProfile); err != nil {
+		t.Fatalf("applyDelta (повторный синк поверх существующего файла): %v", err)
+	}
+
+	got2, err := os.ReadFile(clientFile)
+	if err != nil {
+		t.Fatalf("ReadFile (после повторного синка): %v", err)
+	}
+	if string(got2) != "[user]\n\tname = Art2\n" {
+		t.Fatalf("содержимое .gitconfig после обновления = %q, хотим %q", got2, "[user]\n\tname = Art2\n")
+	}
+}
@@ -0,0 +1,42 @@
+package syncenc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// pbkdf2 — небольшая реализация RFC 2898 PBKDF2 поверх HMAC-SHA256, чтобы не тащить
+// в проект golang.org/x/crypto ради одной функции. Алгоритм идентичен
+// golang.org/x/crypto/pbkdf2.Key.
+func pbkdf2(password string, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, []byte(password))
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var blockIndex [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockIndex[:], uint32(block))
+		prf.Write(blockIndex[:])
+		t := prf.Sum(nil)
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+
+		dk = append(dk, t...)
+	}
+
+	return dk[:keyLen]
+}
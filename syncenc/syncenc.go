@@ -0,0 +1,179 @@
+// Package syncenc оборачивает потоковую передачу архива AES-256-GCM шифрованием,
+// чтобы /sync не гонял настройки и токены по LAN в открытом виде.
+package syncenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// KeySize — размер ключа AES-256 в байтах.
+	KeySize = 32
+	// SaltSize — размер соли для DeriveKey.
+	SaltSize = 16
+	// NonceSize — размер nonce для AES-GCM.
+	NonceSize = 12
+
+	pbkdf2Iterations = 100000
+	chunkSize        = 64 * 1024 // сколько байт открытого текста шифруем за один чанк
+)
+
+// DeriveKey порождает 32-байтный ключ AES-256 из пароля и соли через PBKDF2-SHA256
+// (100 000 итераций). Соль должна быть общей для клиента и сервера — см. NewSalt.
+func DeriveKey(passphrase string, salt []byte) []byte {
+	return pbkdf2(passphrase, salt, pbkdf2Iterations, KeySize)
+}
+
+// NewSalt генерирует случайную 16-байтную соль для DeriveKey.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("syncenc: не удалось сгенерировать соль: %w", err)
+	}
+	return salt, nil
+}
+
+// AuthHMAC считает HMAC-SHA256(method+path+timestamp+filesDigest), ключом служит
+// derived key. Используется в заголовке X-Sync-Auth для защиты /sync и /manifest
+// от replay-атак; filesDigest (см. FilesDigest) привязывает подпись к конкретному
+// списку запрошенных файлов, чтобы перехваченный запрос нельзя было переиграть
+// с другим набором files.
+func AuthHMAC(key []byte, method, path string, timestamp int64, filesDigest string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s%s%d%s", method, path, timestamp, filesDigest)
+	return mac.Sum(nil)
+}
+
+// FilesDigest хэширует список запрошенных файлов (в том порядке, в котором его
+// передал вызывающий — client и server должны использовать один и тот же список),
+// чтобы его можно было включить в AuthHMAC. Пустой/nil список даёт фиксированный
+// дайджест, соответствующий эндпоинтам без выбора файлов (/manifest и полный /sync).
+func FilesDigest(files []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(files, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// encryptingWriter шифрует данные чанками по chunkSize байт открытого текста.
+// Каждый чанк записывается как: 4-байтная длина (big-endian) + nonce (12 байт) + ciphertext+tag.
+type encryptingWriter struct {
+	w   io.Writer
+	gcm cipher.AEAD
+}
+
+// NewEncryptingWriter оборачивает w так, что всё записанное в возвращённый Writer
+// шифруется AES-256-GCM и пишется в w чанками со случайным nonce в каждом.
+// Предназначен для использования вместе с zip.NewWriter.
+func NewEncryptingWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, gcm: gcm}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if err := e.writeChunk(p[:n]); err != nil {
+			return total, err
+		}
+		p = p[n:]
+		total += n
+	}
+	return total, nil
+}
+
+func (e *encryptingWriter) writeChunk(plain []byte) error {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("syncenc: не удалось сгенерировать nonce: %w", err)
+	}
+
+	sealed := e.gcm.Seal(nonce, nonce, plain, nil) // nonce остаётся в начале sealed
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(sealed)))
+	if _, err := e.w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close ничего не шифрует сам по себе — формат самоограничивающийся (каждый чанк
+// несёт свою длину), закрытие исходного io.Writer остаётся на вызывающем коде.
+func (e *encryptingWriter) Close() error {
+	return nil
+}
+
+// decryptingReader читает чанки, записанные encryptingWriter, и отдаёт расшифрованный
+// поток через обычный io.Reader.
+type decryptingReader struct {
+	r   io.Reader
+	gcm cipher.AEAD
+	buf []byte
+}
+
+// NewDecryptingReader — обратная операция к NewEncryptingWriter. Предназначен для
+// использования вместе с zip.NewReader (через io.ReadAll) или потокового чтения.
+func NewDecryptingReader(r io.Reader, key []byte) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{r: r, gcm: gcm}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(d.r, lenBuf[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(d.r, sealed); err != nil {
+			return 0, fmt.Errorf("syncenc: оборванный чанк: %w", err)
+		}
+		if len(sealed) < NonceSize {
+			return 0, errors.New("syncenc: повреждённый чанк: короче nonce")
+		}
+
+		nonce, ciphertext := sealed[:NonceSize], sealed[NonceSize:]
+		plain, err := d.gcm.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return 0, fmt.Errorf("syncenc: не удалось расшифровать чанк (неверный passphrase?): %w", err)
+		}
+		d.buf = plain
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("syncenc: ключ должен быть %d байт, получено %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}